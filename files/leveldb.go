@@ -6,16 +6,14 @@ package files
 
 import (
 	"bytes"
-	"runtime"
+	"encoding/binary"
+	"math"
 	"sort"
 	"sync"
 
 	"github.com/syncthing/syncthing/lamport"
 	"github.com/syncthing/syncthing/protocol"
 	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
-	"github.com/syndtr/goleveldb/leveldb/opt"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 var (
@@ -37,6 +35,8 @@ func clock(v uint64) uint64 {
 const (
 	keyTypeNode = iota
 	keyTypeGlobal
+	keyTypeSequence
+	keyTypeNeedFilter
 )
 
 type fileVersion struct {
@@ -62,15 +62,6 @@ func (l fileList) Less(a, b int) bool {
 	return l[a].Name < l[b].Name
 }
 
-type dbReader interface {
-	Get([]byte, *opt.ReadOptions) ([]byte, error)
-}
-
-type dbWriter interface {
-	Put([]byte, []byte)
-	Delete([]byte)
-}
-
 /*
 
 keyTypeNode (1 byte)
@@ -86,6 +77,12 @@ keyTypeGlobal (1 byte)
 			|
 			[]fileVersion (sorted)
 
+keyTypeSequence (1 byte)
+	repository (64 bytes)
+		local version (8 bytes, big endian)
+			|
+			node (32 bytes) + name (variable size)
+
 */
 
 func nodeKey(repo, node, file []byte) []byte {
@@ -127,125 +124,168 @@ func globalKeyRepo(key []byte) []byte {
 	return repo[:izero]
 }
 
-type deletionHandler func(db dbReader, batch dbWriter, repo, node, name []byte, dbi iterator.Iterator) uint64
+// sequenceKey returns the key for the given (repo, localVersion) pair in the
+// by-sequence index. The index is ordered by localVersion within a repo,
+// which lets ldbChangesSince range-scan it instead of walking every file.
+func sequenceKey(repo []byte, localVersion uint64) []byte {
+	k := make([]byte, 1+64+8)
+	k[0] = keyTypeSequence
+	copy(k[1:], []byte(repo))
+	binary.BigEndian.PutUint64(k[1+64:], localVersion)
+	return k
+}
 
-type fileIterator func(f protocol.FileIntf) bool
+func sequenceKeyRepo(key []byte) []byte {
+	repo := key[1 : 1+64]
+	izero := bytes.IndexByte(repo, 0)
+	return repo[:izero]
+}
+
+// sequenceValue packs the (node, name) pair that a sequence entry points at.
+func sequenceValue(node, name []byte) []byte {
+	v := make([]byte, 32+len(name))
+	copy(v, node)
+	copy(v[32:], name)
+	return v
+}
+
+func sequenceValueNode(v []byte) []byte {
+	return v[:32]
+}
 
-func ldbGenericReplace(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo, deleteFn deletionHandler) uint64 {
-	defer runtime.GC()
+func sequenceValueName(v []byte) []byte {
+	return v[32:]
+}
+
+type deletionHandler func(snap Snapshot, tx Tx, cache *needFilterCache, repo, node, name []byte, dbi RangeIterator) uint64
 
+type fileIterator func(f protocol.FileIntf) bool
+
+// ldbGenericReplace is the largest single Store.Update call in this
+// package - one call can touch every file in a repo - so it's the one
+// most likely to run into Update's chunked-flush threshold. If it fails
+// partway through, writes from batches flushed before the failure have
+// already landed; see the Store.Update doc.
+func ldbGenericReplace(db Store, repo, node []byte, fs []protocol.FileInfo, deleteFn deletionHandler) (uint64, error) {
 	sort.Sort(fileList(fs)) // sort list on name, same as on disk
 
 	start := nodeKey(repo, node, nil)                            // before all repo/node files
 	limit := nodeKey(repo, node, []byte{0xff, 0xff, 0xff, 0xff}) // after all repo/node files
 
-	batch := new(leveldb.Batch)
-	snap, err := db.GetSnapshot()
+	snap, err := db.Snapshot()
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 	defer snap.Release()
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.RangeIterator(start, limit)
 	defer dbi.Release()
 
-	moreDb := dbi.Next()
-	fsi := 0
+	cache := newNeedFilterCache(snap)
+
 	var maxLocalVer uint64
+	err = db.Update(func(tx Tx) error {
+		moreDb := dbi.Next()
+		fsi := 0
 
-	for {
-		var newName, oldName []byte
-		moreFs := fsi < len(fs)
+		for {
+			var newName, oldName []byte
+			moreFs := fsi < len(fs)
 
-		if !moreDb && !moreFs {
-			break
-		}
+			if !moreDb && !moreFs {
+				break
+			}
 
-		if !moreFs && deleteFn == nil {
-			// We don't have any more updated files to process and deletion
-			// has not been requested, so we can exit early
-			break
-		}
+			if !moreFs && deleteFn == nil {
+				// We don't have any more updated files to process and deletion
+				// has not been requested, so we can exit early
+				break
+			}
 
-		if moreFs {
-			newName = []byte(fs[fsi].Name)
-		}
+			if moreFs {
+				newName = []byte(fs[fsi].Name)
+			}
 
-		if moreDb {
-			oldName = nodeKeyName(dbi.Key())
-		}
+			if moreDb {
+				oldName = nodeKeyName(dbi.Key())
+			}
 
-		cmp := bytes.Compare(newName, oldName)
+			cmp := bytes.Compare(newName, oldName)
 
-		if debug {
-			l.Debugf("generic replace; repo=%q node=%v moreFs=%v moreDb=%v cmp=%d newName=%q oldName=%q", repo, protocol.NodeIDFromBytes(node), moreFs, moreDb, cmp, newName, oldName)
-		}
-
-		switch {
-		case moreFs && (!moreDb || cmp == -1):
-			// Disk is missing this file. Insert it.
-			if lv := ldbInsert(batch, repo, node, newName, fs[fsi]); lv > maxLocalVer {
-				maxLocalVer = lv
-			}
-			if fs[fsi].IsInvalid() {
-				ldbRemoveFromGlobal(snap, batch, repo, node, newName)
-			} else {
-				ldbUpdateGlobal(snap, batch, repo, node, newName, fs[fsi].Version)
+			if debug {
+				l.Debugf("generic replace; repo=%q node=%v moreFs=%v moreDb=%v cmp=%d newName=%q oldName=%q", repo, protocol.NodeIDFromBytes(node), moreFs, moreDb, cmp, newName, oldName)
 			}
-			fsi++
 
-		case moreFs && moreDb && cmp == 0:
-			// File exists on both sides - compare versions. We might get an
-			// update with the same version and different flags if a node has
-			// marked a file as invalid, so handle that too.
-			var ef protocol.FileInfoTruncated
-			ef.UnmarshalXDR(dbi.Value())
-			if fs[fsi].Version > ef.Version || fs[fsi].Version != ef.Version {
-				if lv := ldbInsert(batch, repo, node, newName, fs[fsi]); lv > maxLocalVer {
+			switch {
+			case moreFs && (!moreDb || cmp == -1):
+				// Disk is missing this file. Insert it.
+				if lv := ldbInsert(tx, repo, node, newName, fs[fsi], 0); lv > maxLocalVer {
 					maxLocalVer = lv
 				}
 				if fs[fsi].IsInvalid() {
-					ldbRemoveFromGlobal(snap, batch, repo, node, newName)
+					ldbRemoveFromGlobal(snap, tx, cache, repo, node, newName)
 				} else {
-					ldbUpdateGlobal(snap, batch, repo, node, newName, fs[fsi].Version)
+					ldbUpdateGlobal(snap, tx, cache, repo, node, newName, fs[fsi].Version)
 				}
-			}
-			// Iterate both sides.
-			fsi++
-			moreDb = dbi.Next()
-
-		case moreDb && (!moreFs || cmp == 1):
-			if deleteFn != nil {
-				if lv := deleteFn(snap, batch, repo, node, oldName, dbi); lv > maxLocalVer {
-					maxLocalVer = lv
+				fsi++
+
+			case moreFs && moreDb && cmp == 0:
+				// File exists on both sides - compare versions. We might get an
+				// update with the same version and different flags if a node has
+				// marked a file as invalid, so handle that too.
+				var ef protocol.FileInfoTruncated
+				ef.UnmarshalXDR(dbi.Value())
+				if fs[fsi].Version > ef.Version || fs[fsi].Version != ef.Version {
+					if lv := ldbInsert(tx, repo, node, newName, fs[fsi], ef.LocalVersion); lv > maxLocalVer {
+						maxLocalVer = lv
+					}
+					if fs[fsi].IsInvalid() {
+						ldbRemoveFromGlobal(snap, tx, cache, repo, node, newName)
+					} else {
+						ldbUpdateGlobal(snap, tx, cache, repo, node, newName, fs[fsi].Version)
+					}
 				}
+				// Iterate both sides.
+				fsi++
+				moreDb = dbi.Next()
+
+			case moreDb && (!moreFs || cmp == 1):
+				if deleteFn != nil {
+					if lv := deleteFn(snap, tx, cache, repo, node, oldName, dbi); lv > maxLocalVer {
+						maxLocalVer = lv
+					}
+				}
+				moreDb = dbi.Next()
 			}
-			moreDb = dbi.Next()
 		}
-	}
 
-	err = db.Write(batch, nil)
+		cache.flush(tx)
+		return nil
+	})
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
-	return maxLocalVer
+	return maxLocalVer, nil
 }
 
-func ldbReplace(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo) uint64 {
+func ldbReplace(db Store, repo, node []byte, fs []protocol.FileInfo) (uint64, error) {
 	// TODO: Return the remaining maxLocalVer?
-	return ldbGenericReplace(db, repo, node, fs, func(db dbReader, batch dbWriter, repo, node, name []byte, dbi iterator.Iterator) uint64 {
+	return ldbGenericReplace(db, repo, node, fs, func(snap Snapshot, tx Tx, cache *needFilterCache, repo, node, name []byte, dbi RangeIterator) uint64 {
 		// Disk has files that we are missing. Remove it.
 		if debug {
 			l.Debugf("delete; repo=%q node=%v name=%q", repo, protocol.NodeIDFromBytes(node), name)
 		}
-		ldbRemoveFromGlobal(db, batch, repo, node, name)
-		batch.Delete(dbi.Key())
+		var ef protocol.FileInfoTruncated
+		ef.UnmarshalXDR(dbi.Value())
+		ldbRemoveFromGlobal(snap, tx, cache, repo, node, name)
+		tx.Delete(dbi.Key())
+		tx.Delete(sequenceKey(repo, ef.LocalVersion))
 		return 0
 	})
 }
 
-func ldbReplaceWithDelete(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo) uint64 {
-	return ldbGenericReplace(db, repo, node, fs, func(db dbReader, batch dbWriter, repo, node, name []byte, dbi iterator.Iterator) uint64 {
+func ldbReplaceWithDelete(db Store, repo, node []byte, fs []protocol.FileInfo) (uint64, error) {
+	return ldbGenericReplace(db, repo, node, fs, func(snap Snapshot, tx Tx, cache *needFilterCache, repo, node, name []byte, dbi RangeIterator) uint64 {
 		var tf protocol.FileInfoTruncated
 		err := tf.UnmarshalXDR(dbi.Value())
 		if err != nil {
@@ -263,69 +303,80 @@ func ldbReplaceWithDelete(db *leveldb.DB, repo, node []byte, fs []protocol.FileI
 				Flags:        tf.Flags | protocol.FlagDeleted,
 				Modified:     tf.Modified,
 			}
-			batch.Put(dbi.Key(), f.MarshalXDR())
-			ldbUpdateGlobal(db, batch, repo, node, nodeKeyName(dbi.Key()), f.Version)
+			tx.Put(dbi.Key(), f.MarshalXDR())
+			ldbUpdateGlobal(snap, tx, cache, repo, node, nodeKeyName(dbi.Key()), f.Version)
+			tx.Delete(sequenceKey(repo, tf.LocalVersion))
+			tx.Put(sequenceKey(repo, ts), sequenceValue(node, nodeKeyName(dbi.Key())))
 			return ts
 		}
 		return 0
 	})
 }
 
-func ldbUpdate(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo) uint64 {
-	defer runtime.GC()
-
-	batch := new(leveldb.Batch)
-	snap, err := db.GetSnapshot()
+func ldbUpdate(db Store, repo, node []byte, fs []protocol.FileInfo) (uint64, error) {
+	snap, err := db.Snapshot()
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 	defer snap.Release()
 
+	cache := newNeedFilterCache(snap)
+
 	var maxLocalVer uint64
-	for _, f := range fs {
-		name := []byte(f.Name)
-		fk := nodeKey(repo, node, name)
-		bs, err := snap.Get(fk, nil)
-		if err == leveldb.ErrNotFound {
-			if lv := ldbInsert(batch, repo, node, name, f); lv > maxLocalVer {
-				maxLocalVer = lv
+	err = db.Update(func(tx Tx) error {
+		for _, f := range fs {
+			name := []byte(f.Name)
+			fk := nodeKey(repo, node, name)
+			bs, err := snap.Get(fk)
+			if err == leveldb.ErrNotFound {
+				if lv := ldbInsert(tx, repo, node, name, f, 0); lv > maxLocalVer {
+					maxLocalVer = lv
+				}
+				if f.IsInvalid() {
+					ldbRemoveFromGlobal(snap, tx, cache, repo, node, name)
+				} else {
+					ldbUpdateGlobal(snap, tx, cache, repo, node, name, f.Version)
+				}
+				continue
 			}
-			if f.IsInvalid() {
-				ldbRemoveFromGlobal(snap, batch, repo, node, name)
-			} else {
-				ldbUpdateGlobal(snap, batch, repo, node, name, f.Version)
+			if err != nil {
+				return err
 			}
-			continue
-		}
 
-		var ef protocol.FileInfoTruncated
-		err = ef.UnmarshalXDR(bs)
-		if err != nil {
-			panic(err)
-		}
-		// Flags might change without the version being bumped when we set the
-		// invalid flag on an existing file.
-		if ef.Version != f.Version || ef.Flags != f.Flags {
-			if lv := ldbInsert(batch, repo, node, name, f); lv > maxLocalVer {
-				maxLocalVer = lv
+			var ef protocol.FileInfoTruncated
+			err = ef.UnmarshalXDR(bs)
+			if err != nil {
+				panic(err)
 			}
-			if f.IsInvalid() {
-				ldbRemoveFromGlobal(snap, batch, repo, node, name)
-			} else {
-				ldbUpdateGlobal(snap, batch, repo, node, name, f.Version)
+			// Flags might change without the version being bumped when we set the
+			// invalid flag on an existing file.
+			if ef.Version != f.Version || ef.Flags != f.Flags {
+				if lv := ldbInsert(tx, repo, node, name, f, ef.LocalVersion); lv > maxLocalVer {
+					maxLocalVer = lv
+				}
+				if f.IsInvalid() {
+					ldbRemoveFromGlobal(snap, tx, cache, repo, node, name)
+				} else {
+					ldbUpdateGlobal(snap, tx, cache, repo, node, name, f.Version)
+				}
 			}
 		}
-	}
 
-	err = db.Write(batch, nil)
+		cache.flush(tx)
+		return nil
+	})
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
-	return maxLocalVer
+	return maxLocalVer, nil
 }
 
-func ldbInsert(batch dbWriter, repo, node, name []byte, file protocol.FileInfo) uint64 {
+// ldbInsert stores the file under its node key and maintains the by-sequence
+// index. oldLocalVersion is the LocalVersion of the record being superseded,
+// if any (0 if this is a new entry), and is used to prune the stale sequence
+// entry so the index doesn't accumulate dead versions.
+func ldbInsert(tx Tx, repo, node, name []byte, file protocol.FileInfo, oldLocalVersion uint64) uint64 {
 	if debug {
 		l.Debugf("insert; repo=%q node=%v %v", repo, protocol.NodeIDFromBytes(node), file)
 	}
@@ -335,7 +386,12 @@ func ldbInsert(batch dbWriter, repo, node, name []byte, file protocol.FileInfo)
 	}
 
 	nk := nodeKey(repo, node, name)
-	batch.Put(nk, file.MarshalXDR())
+	tx.Put(nk, file.MarshalXDR())
+
+	if oldLocalVersion != 0 {
+		tx.Delete(sequenceKey(repo, oldLocalVersion))
+	}
+	tx.Put(sequenceKey(repo, file.LocalVersion), sequenceValue(node, name))
 
 	return file.LocalVersion
 }
@@ -343,17 +399,21 @@ func ldbInsert(batch dbWriter, repo, node, name []byte, file protocol.FileInfo)
 // ldbUpdateGlobal adds this node+version to the version list for the given
 // file. If the node is already present in the list, the version is updated.
 // If the file does not have an entry in the global list, it is created.
-func ldbUpdateGlobal(db dbReader, batch dbWriter, repo, node, file []byte, version uint64) bool {
+// node's need filter bit for file is recorded in cache as "may still need"
+// if it's behind the new top version - see the needFilter doc for why
+// there's no symmetric "caught up" bit to clear.
+func ldbUpdateGlobal(snap Snapshot, tx Tx, cache *needFilterCache, repo, node, file []byte, version uint64) bool {
 	if debug {
 		l.Debugf("update global; repo=%q node=%v file=%q version=%d", repo, protocol.NodeIDFromBytes(node), file, version)
 	}
 	gk := globalKey(repo, file)
-	svl, err := db.Get(gk, nil)
+	svl, err := snap.Get(gk)
 	if err != nil && err != leveldb.ErrNotFound {
 		panic(err)
 	}
 
 	var fl versionList
+	var oldTopVersion uint64
 	nv := fileVersion{
 		node:    node,
 		version: version,
@@ -363,6 +423,9 @@ func ldbUpdateGlobal(db dbReader, batch dbWriter, repo, node, file []byte, versi
 		if err != nil {
 			panic(err)
 		}
+		if len(fl.versions) > 0 {
+			oldTopVersion = fl.versions[0].version
+		}
 
 		for i := range fl.versions {
 			if bytes.Compare(fl.versions[i].node, node) == 0 {
@@ -389,21 +452,41 @@ func ldbUpdateGlobal(db dbReader, batch dbWriter, repo, node, file []byte, versi
 	fl.versions = append(fl.versions, nv)
 
 done:
-	batch.Put(gk, fl.MarshalXDR())
+	tx.Put(gk, fl.MarshalXDR())
+
+	newTopVersion := fl.versions[0].version
+	ldbUpdateNeedFilter(cache, repo, node, file, newTopVersion != version)
+	if newTopVersion != oldTopVersion {
+		// The global top version moved, so every other node that was
+		// previously tied with it is now behind and may need this file.
+		// Without this, ldbWithNeed would skip those nodes forever: its
+		// filter check short-circuits before the versionList is ever
+		// decoded, so there's no other place that would notice.
+		for i := range fl.versions {
+			if bytes.Compare(fl.versions[i].node, node) == 0 {
+				continue
+			}
+			if fl.versions[i].version == oldTopVersion {
+				ldbUpdateNeedFilter(cache, repo, fl.versions[i].node, file, true)
+			}
+		}
+	}
 
 	return true
 }
 
 // ldbRemoveFromGlobal removes the node from the global version list for the
 // given file. If the version list is empty after this, the file entry is
-// removed entirely.
-func ldbRemoveFromGlobal(db dbReader, batch dbWriter, repo, node, file []byte) {
+// removed entirely. The node no longer has a claim on file, so it may need
+// whatever remains the global version, and its need filter bit is recorded
+// as "may still need" in cache.
+func ldbRemoveFromGlobal(snap Snapshot, tx Tx, cache *needFilterCache, repo, node, file []byte) {
 	if debug {
 		l.Debugf("remove from global; repo=%q node=%v file=%q", repo, protocol.NodeIDFromBytes(node), file)
 	}
 
 	gk := globalKey(repo, file)
-	svl, err := db.Get(gk, nil)
+	svl, err := snap.Get(gk)
 	if err != nil {
 		// We might be called to "remove" a global version that doesn't exist
 		// if the first update for the file is already marked invalid.
@@ -424,21 +507,22 @@ func ldbRemoveFromGlobal(db dbReader, batch dbWriter, repo, node, file []byte) {
 	}
 
 	if len(fl.versions) == 0 {
-		batch.Delete(gk)
+		tx.Delete(gk)
 	} else {
-		batch.Put(gk, fl.MarshalXDR())
+		tx.Put(gk, fl.MarshalXDR())
 	}
+	ldbUpdateNeedFilter(cache, repo, node, file, true)
 }
 
-func ldbWithHave(db *leveldb.DB, repo, node []byte, truncate bool, fn fileIterator) {
+func ldbWithHave(db Store, repo, node []byte, truncate bool, fn fileIterator) error {
 	start := nodeKey(repo, node, nil)                            // before all repo/node files
 	limit := nodeKey(repo, node, []byte{0xff, 0xff, 0xff, 0xff}) // after all repo/node files
-	snap, err := db.GetSnapshot()
+	snap, err := db.Snapshot()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer snap.Release()
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.RangeIterator(start, limit)
 	defer dbi.Release()
 
 	for dbi.Next() {
@@ -447,22 +531,21 @@ func ldbWithHave(db *leveldb.DB, repo, node []byte, truncate bool, fn fileIterat
 			panic(err)
 		}
 		if cont := fn(f); !cont {
-			return
+			return nil
 		}
 	}
+	return nil
 }
 
-func ldbWithAllRepoTruncated(db *leveldb.DB, repo []byte, fn func(node []byte, f protocol.FileInfoTruncated) bool) {
-	defer runtime.GC()
-
+func ldbWithAllRepoTruncated(db Store, repo []byte, fn func(node []byte, f protocol.FileInfoTruncated) bool) error {
 	start := nodeKey(repo, nil, nil)                                                // before all repo/node files
 	limit := nodeKey(repo, protocol.LocalNodeID[:], []byte{0xff, 0xff, 0xff, 0xff}) // after all repo/node files
-	snap, err := db.GetSnapshot()
+	snap, err := db.Snapshot()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer snap.Release()
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.RangeIterator(start, limit)
 	defer dbi.Release()
 
 	for dbi.Next() {
@@ -473,19 +556,20 @@ func ldbWithAllRepoTruncated(db *leveldb.DB, repo []byte, fn func(node []byte, f
 			panic(err)
 		}
 		if cont := fn(node, f); !cont {
-			return
+			return nil
 		}
 	}
+	return nil
 }
 
-func ldbGet(db *leveldb.DB, repo, node, file []byte) protocol.FileInfo {
+func ldbGet(db Store, repo, node, file []byte) (protocol.FileInfo, error) {
 	nk := nodeKey(repo, node, file)
-	bs, err := db.Get(nk, nil)
+	bs, err := db.Get(nk)
 	if err == leveldb.ErrNotFound {
-		return protocol.FileInfo{}
+		return protocol.FileInfo{}, nil
 	}
 	if err != nil {
-		panic(err)
+		return protocol.FileInfo{}, err
 	}
 
 	var f protocol.FileInfo
@@ -493,23 +577,23 @@ func ldbGet(db *leveldb.DB, repo, node, file []byte) protocol.FileInfo {
 	if err != nil {
 		panic(err)
 	}
-	return f
+	return f, nil
 }
 
-func ldbGetGlobal(db *leveldb.DB, repo, file []byte) protocol.FileInfo {
+func ldbGetGlobal(db Store, repo, file []byte) (protocol.FileInfo, error) {
 	k := globalKey(repo, file)
-	snap, err := db.GetSnapshot()
+	snap, err := db.Snapshot()
 	if err != nil {
-		panic(err)
+		return protocol.FileInfo{}, err
 	}
 	defer snap.Release()
 
-	bs, err := snap.Get(k, nil)
+	bs, err := snap.Get(k)
 	if err == leveldb.ErrNotFound {
-		return protocol.FileInfo{}
+		return protocol.FileInfo{}, nil
 	}
 	if err != nil {
-		panic(err)
+		return protocol.FileInfo{}, err
 	}
 
 	var vl versionList
@@ -523,9 +607,9 @@ func ldbGetGlobal(db *leveldb.DB, repo, file []byte) protocol.FileInfo {
 	}
 
 	k = nodeKey(repo, vl.versions[0].node, file)
-	bs, err = snap.Get(k, nil)
+	bs, err = snap.Get(k)
 	if err != nil {
-		panic(err)
+		return protocol.FileInfo{}, err
 	}
 
 	var f protocol.FileInfo
@@ -533,20 +617,18 @@ func ldbGetGlobal(db *leveldb.DB, repo, file []byte) protocol.FileInfo {
 	if err != nil {
 		panic(err)
 	}
-	return f
+	return f, nil
 }
 
-func ldbWithGlobal(db *leveldb.DB, repo []byte, truncate bool, fn fileIterator) {
-	defer runtime.GC()
-
+func ldbWithGlobal(db Store, repo []byte, truncate bool, fn fileIterator) error {
 	start := globalKey(repo, nil)
 	limit := globalKey(repo, []byte{0xff, 0xff, 0xff, 0xff})
-	snap, err := db.GetSnapshot()
+	snap, err := db.Snapshot()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer snap.Release()
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.RangeIterator(start, limit)
 	defer dbi.Release()
 
 	for dbi.Next() {
@@ -560,9 +642,9 @@ func ldbWithGlobal(db *leveldb.DB, repo []byte, truncate bool, fn fileIterator)
 			panic("no versions?")
 		}
 		fk := nodeKey(repo, vl.versions[0].node, globalKeyName(dbi.Key()))
-		bs, err := snap.Get(fk, nil)
+		bs, err := snap.Get(fk)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		f, err := unmarshalTrunc(bs, truncate)
@@ -571,19 +653,20 @@ func ldbWithGlobal(db *leveldb.DB, repo []byte, truncate bool, fn fileIterator)
 		}
 
 		if cont := fn(f); !cont {
-			return
+			return nil
 		}
 	}
+	return nil
 }
 
-func ldbAvailability(db *leveldb.DB, repo, file []byte) []protocol.NodeID {
+func ldbAvailability(db Store, repo, file []byte) ([]protocol.NodeID, error) {
 	k := globalKey(repo, file)
-	bs, err := db.Get(k, nil)
+	bs, err := db.Get(k)
 	if err == leveldb.ErrNotFound {
-		return nil
+		return nil, nil
 	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	var vl versionList
@@ -601,24 +684,37 @@ func ldbAvailability(db *leveldb.DB, repo, file []byte) []protocol.NodeID {
 		nodes = append(nodes, n)
 	}
 
-	return nodes
+	return nodes, nil
 }
 
-func ldbWithNeed(db *leveldb.DB, repo, node []byte, truncate bool, fn fileIterator) {
-	defer runtime.GC()
-
+func ldbWithNeed(db Store, repo, node []byte, truncate bool, fn fileIterator) error {
 	start := globalKey(repo, nil)
 	limit := globalKey(repo, []byte{0xff, 0xff, 0xff, 0xff})
-	snap, err := db.GetSnapshot()
+	snap, err := db.Snapshot()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer snap.Release()
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.RangeIterator(start, limit)
 	defer dbi.Release()
 
+	nf, err := ldbLoadOrRebuildNeedFilter(db, snap, repo, node)
+	if err != nil {
+		return err
+	}
+
 outer:
 	for dbi.Next() {
+		if !nf.Test(globalKeyName(dbi.Key())) {
+			// The need filter is certain node doesn't need this file, so
+			// there's nothing to decode the version list for. A true
+			// Test result, by contrast, may be a false positive - that
+			// just costs one extra decode here to find out node was
+			// actually fine; see the needFilter doc for why the filter
+			// can only ever err in this direction.
+			continue outer
+		}
+
 		var vl versionList
 		err := vl.UnmarshalXDR(dbi.Value())
 		if err != nil {
@@ -651,9 +747,9 @@ outer:
 					continue outer
 				}
 				fk := nodeKey(repo, vl.versions[i].node, name)
-				bs, err := snap.Get(fk, nil)
+				bs, err := snap.Get(fk)
 				if err != nil {
-					panic(err)
+					return err
 				}
 
 				gf, err := unmarshalTrunc(bs, truncate)
@@ -676,7 +772,7 @@ outer:
 				}
 
 				if cont := fn(gf); !cont {
-					return
+					return nil
 				}
 
 				// This file is handled, no need to look further in the version list
@@ -684,28 +780,79 @@ outer:
 			}
 		}
 	}
+	return nil
 }
 
-func ldbListRepos(db *leveldb.DB) []string {
-	defer runtime.GC()
-
-	start := []byte{keyTypeGlobal}
-	limit := []byte{keyTypeGlobal + 1}
-	snap, err := db.GetSnapshot()
+// ldbChangesSince streams files in the repo whose LocalVersion is greater
+// than sinceLocalVersion, in monotonically increasing LocalVersion order, by
+// range-scanning the by-sequence index rather than the full node bucket.
+// This lets a consumer resume from the LocalVersion of the last file it saw,
+// analogous to a CouchDB-style _changes feed.
+func ldbChangesSince(db Store, repo []byte, sinceLocalVersion uint64, fn fileIterator) error {
+	start := sequenceKey(repo, sinceLocalVersion+1)
+	limit := sequenceKey(repo, math.MaxUint64)
+	snap, err := db.Snapshot()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer snap.Release()
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.RangeIterator(start, limit)
 	defer dbi.Release()
 
-	repoExists := make(map[string]bool)
 	for dbi.Next() {
-		repo := string(globalKeyRepo(dbi.Key()))
-		if !repoExists[repo] {
-			repoExists[repo] = true
+		node := sequenceValueNode(dbi.Value())
+		name := sequenceValueName(dbi.Value())
+
+		fk := nodeKey(repo, node, name)
+		bs, err := snap.Get(fk)
+		if err == leveldb.ErrNotFound {
+			// The node entry has since been superseded or removed and the
+			// stale sequence entry hasn't been pruned yet; skip it.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var f protocol.FileInfo
+		err = f.UnmarshalXDR(bs)
+		if err != nil {
+			panic(err)
+		}
+
+		if cont := fn(f); !cont {
+			return nil
 		}
 	}
+	return nil
+}
+
+// ldbListRepos returns the names of every repo with at least one entry in
+// either the global or the node bucket. It reads both - rather than just
+// the global bucket - because a repo whose global index is empty or
+// missing (e.g. corruption, or a crash mid-ldbDropRepo/replace) is exactly
+// the case ldbRepair exists to fix, and callers like repairAllRepos need
+// to find it to repair it in the first place.
+func ldbListRepos(db Store) ([]string, error) {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	repoExists := make(map[string]bool)
+
+	gdbi := snap.RangeIterator([]byte{keyTypeGlobal}, []byte{keyTypeGlobal + 1})
+	for gdbi.Next() {
+		repoExists[string(globalKeyRepo(gdbi.Key()))] = true
+	}
+	gdbi.Release()
+
+	ndbi := snap.RangeIterator([]byte{keyTypeNode}, []byte{keyTypeNode + 1})
+	for ndbi.Next() {
+		repoExists[string(nodeKeyRepo(ndbi.Key()))] = true
+	}
+	ndbi.Release()
 
 	repos := make([]string, 0, len(repoExists))
 	for k := range repoExists {
@@ -713,41 +860,72 @@ func ldbListRepos(db *leveldb.DB) []string {
 	}
 
 	sort.Strings(repos)
-	return repos
+	return repos, nil
 }
 
-func ldbDropRepo(db *leveldb.DB, repo []byte) {
-	defer runtime.GC()
-
-	snap, err := db.GetSnapshot()
+// ldbDropRepo deletes every key belonging to repo across all four
+// buckets in one Store.Update call. Like ldbGenericReplace, a large
+// repo can push this past Update's chunked-flush threshold; a failure
+// partway through can leave repo partially dropped rather than
+// untouched, per the Store.Update doc.
+func ldbDropRepo(db Store, repo []byte) error {
+	snap, err := db.Snapshot()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer snap.Release()
 
-	// Remove all items related to the given repo from the node->file bucket
-	start := []byte{keyTypeNode}
-	limit := []byte{keyTypeNode + 1}
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
-	for dbi.Next() {
-		itemRepo := nodeKeyRepo(dbi.Key())
-		if bytes.Compare(repo, itemRepo) == 0 {
-			db.Delete(dbi.Key(), nil)
+	return db.Update(func(tx Tx) error {
+		// Remove all items related to the given repo from the node->file bucket
+		start := []byte{keyTypeNode}
+		limit := []byte{keyTypeNode + 1}
+		dbi := snap.RangeIterator(start, limit)
+		for dbi.Next() {
+			itemRepo := nodeKeyRepo(dbi.Key())
+			if bytes.Compare(repo, itemRepo) == 0 {
+				tx.Delete(dbi.Key())
+			}
 		}
-	}
-	dbi.Release()
+		dbi.Release()
 
-	// Remove all items related to the given repo from the global bucket
-	start = []byte{keyTypeGlobal}
-	limit = []byte{keyTypeGlobal + 1}
-	dbi = snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
-	for dbi.Next() {
-		itemRepo := globalKeyRepo(dbi.Key())
-		if bytes.Compare(repo, itemRepo) == 0 {
-			db.Delete(dbi.Key(), nil)
+		// Remove all items related to the given repo from the global bucket
+		start = []byte{keyTypeGlobal}
+		limit = []byte{keyTypeGlobal + 1}
+		dbi = snap.RangeIterator(start, limit)
+		for dbi.Next() {
+			itemRepo := globalKeyRepo(dbi.Key())
+			if bytes.Compare(repo, itemRepo) == 0 {
+				tx.Delete(dbi.Key())
+			}
 		}
-	}
-	dbi.Release()
+		dbi.Release()
+
+		// Remove all items related to the given repo from the by-sequence index
+		start = []byte{keyTypeSequence}
+		limit = []byte{keyTypeSequence + 1}
+		dbi = snap.RangeIterator(start, limit)
+		for dbi.Next() {
+			itemRepo := sequenceKeyRepo(dbi.Key())
+			if bytes.Compare(repo, itemRepo) == 0 {
+				tx.Delete(dbi.Key())
+			}
+		}
+		dbi.Release()
+
+		// Remove all items related to the given repo from the need-filter bucket
+		start = []byte{keyTypeNeedFilter}
+		limit = []byte{keyTypeNeedFilter + 1}
+		dbi = snap.RangeIterator(start, limit)
+		for dbi.Next() {
+			itemRepo := needFilterKeyRepo(dbi.Key())
+			if bytes.Compare(repo, itemRepo) == 0 {
+				tx.Delete(dbi.Key())
+			}
+		}
+		dbi.Release()
+
+		return nil
+	})
 }
 
 func unmarshalTrunc(bs []byte, truncate bool) (protocol.FileIntf, error) {
@@ -0,0 +1,254 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package files
+
+import (
+	"bytes"
+	"hash/fnv"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// needFilterBits is the size, in bits, of a per-(repo,node) need filter.
+const needFilterBits = 1 << 16
+
+// needFilterHashes is the number of bit positions each name sets/tests in
+// the filter. A single shared bit per name (k=1) means one collision
+// between two arbitrary names - reachable within roughly the first
+// sqrt(needFilterBits) names inserted, per the birthday bound, i.e.
+// trivially in any real repo - flips the two names' status together.
+// Spreading each name across several independent bits (k>=3) means a false
+// positive requires every one of those bits to be separately collided
+// into, which is why this is a real Bloom filter rather than a bitmap.
+const needFilterHashes = 4
+
+// needFilter is a per-(repo,node) record of which globally-latest files a
+// node may still need. ldbWithNeed consults it to skip decoding the
+// versionList for files it's certain the node doesn't need, turning an
+// O(files-in-repo) decode into an O(1) bit test for the common case of a
+// mostly up-to-date node.
+//
+// The filter only ever records "may still need" (Set), never "caught up":
+// because several names share bits, clearing a name's bits on "caught up"
+// could also clear a bit a colliding name still depends on, turning a
+// false positive (an unnecessary decode - safe) into a false negative (a
+// hidden need - not safe). So a true Test result can be a false positive
+// costing one extra decode, but a false result is always accurate. The
+// filter only shrinks via a full ldbRebuildNeedFilter.
+type needFilter struct {
+	bits []byte
+}
+
+func newNeedFilter() *needFilter {
+	return &needFilter{bits: make([]byte, needFilterBits/8)}
+}
+
+func needFilterFromBytes(bs []byte) *needFilter {
+	if len(bs) != needFilterBits/8 {
+		// Wrong size (never written, or the filter layout changed);
+		// treat as empty rather than guessing at a conversion.
+		return newNeedFilter()
+	}
+	f := &needFilter{bits: make([]byte, len(bs))}
+	copy(f.bits, bs)
+	return f
+}
+
+// needFilterIndexes returns the needFilterHashes bit positions name maps
+// to. Rather than running needFilterHashes independent hash functions, it
+// combines two (fnv32a and fnv32) via the standard Kirsch-Mitzenmacher
+// construction, h_i = h1 + i*h2, which is statistically equivalent for
+// Bloom filter purposes.
+func needFilterIndexes(name []byte) [needFilterHashes]uint32 {
+	ha := fnv.New32a()
+	ha.Write(name)
+	hb := fnv.New32()
+	hb.Write(name)
+	h1, h2 := ha.Sum32(), hb.Sum32()
+
+	var idx [needFilterHashes]uint32
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) % needFilterBits
+	}
+	return idx
+}
+
+// Set records that the node may still need the global version of name.
+// There is deliberately no complementary Clear; see the needFilter doc.
+func (f *needFilter) Set(name []byte) {
+	for _, i := range needFilterIndexes(name) {
+		f.bits[i/8] |= 1 << (i % 8)
+	}
+}
+
+// Test reports whether the filter believes the node may still need the
+// global version of name. A true result may be a false positive; a false
+// result is always accurate.
+func (f *needFilter) Test(name []byte) bool {
+	for _, i := range needFilterIndexes(name) {
+		if f.bits[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func needFilterKey(repo, node []byte) []byte {
+	k := make([]byte, 1+64+32)
+	k[0] = keyTypeNeedFilter
+	copy(k[1:], repo)
+	copy(k[1+64:], node)
+	return k
+}
+
+func needFilterKeyRepo(key []byte) []byte {
+	repo := key[1 : 1+64]
+	izero := bytes.IndexByte(repo, 0)
+	return repo[:izero]
+}
+
+// ldbLoadNeedFilter returns node's need filter for repo, or an empty one if
+// none has been recorded yet.
+func ldbLoadNeedFilter(snap Snapshot, repo, node []byte) (*needFilter, error) {
+	bs, err := snap.Get(needFilterKey(repo, node))
+	if err == leveldb.ErrNotFound {
+		return newNeedFilter(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return needFilterFromBytes(bs), nil
+}
+
+// needFilterCache holds the working copies of need filters touched during
+// a single Store.Update call, keyed by (repo,node). ldbUpdateGlobal and
+// ldbRemoveFromGlobal can be called several times for the same (repo,node)
+// within one Update - e.g. once per file in ldbGenericReplace/ldbUpdate -
+// and a Tx can't Get back its own uncommitted writes, so without this
+// cache each call after the first would reload the pre-transaction
+// baseline from the outer snapshot and overwrite whatever the previous
+// call in the same Update set. Call flush once, after the last mutation,
+// to persist every filter touched.
+type needFilterCache struct {
+	snap    Snapshot
+	filters map[string]*needFilter
+}
+
+func newNeedFilterCache(snap Snapshot) *needFilterCache {
+	return &needFilterCache{snap: snap, filters: make(map[string]*needFilter)}
+}
+
+// get returns the working copy of node's need filter for repo, loading it
+// from the cache's snapshot the first time it's asked for and handing back
+// the same instance on every later call within this Update.
+func (c *needFilterCache) get(repo, node []byte) *needFilter {
+	key := string(needFilterKey(repo, node))
+	if nf, ok := c.filters[key]; ok {
+		return nf
+	}
+	nf, err := ldbLoadNeedFilter(c.snap, repo, node)
+	if err != nil {
+		panic(err)
+	}
+	c.filters[key] = nf
+	return nf
+}
+
+// flush persists every filter that was touched via get since the cache was
+// created.
+func (c *needFilterCache) flush(tx Tx) {
+	for key, nf := range c.filters {
+		tx.Put([]byte(key), nf.bits)
+	}
+}
+
+// ldbUpdateNeedFilter records, in cache's in-memory working copy, that
+// node may still need file if needsSync is true. A false needsSync is a
+// no-op: the filter has no safe way to unset file's bits (see the
+// needFilter doc), so "caught up" is simply never recorded, and any stale
+// "may still need" bits persist - costing an extra decode, never hiding a
+// real need - until the next ldbRebuildNeedFilter. The change is not
+// persisted until cache.flush is called.
+func ldbUpdateNeedFilter(cache *needFilterCache, repo, node, file []byte, needsSync bool) {
+	if !needsSync {
+		return
+	}
+	cache.get(repo, node).Set(file)
+}
+
+// ldbRebuildNeedFilter regenerates node's need filter for repo from
+// scratch by walking the global version list, persists it, and returns it.
+// Use it to resynchronize a filter that's drifted away from
+// ldbUpdateGlobal/ldbRemoveFromGlobal's incremental maintenance - for
+// example after restoring a backup taken mid-batch, or (via
+// ldbLoadOrRebuildNeedFilter) the first time a node's filter is consulted
+// and no persisted filter exists yet.
+func ldbRebuildNeedFilter(db Store, repo, node []byte) (*needFilter, error) {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	nf := newNeedFilter()
+
+	start := globalKey(repo, nil)
+	limit := globalKey(repo, []byte{0xff, 0xff, 0xff, 0xff})
+	dbi := snap.RangeIterator(start, limit)
+	defer dbi.Release()
+
+	for dbi.Next() {
+		var vl versionList
+		if err := vl.UnmarshalXDR(dbi.Value()); err != nil {
+			return nil, err
+		}
+		if len(vl.versions) == 0 {
+			continue
+		}
+		atTop := false
+		for _, v := range vl.versions {
+			if v.version != vl.versions[0].version {
+				break
+			}
+			if bytes.Equal(v.node, node) {
+				atTop = true
+				break
+			}
+		}
+		if !atTop {
+			// node is absent from the global list entirely, or present
+			// but tied with something other than the top version -
+			// either way it may still need this file.
+			nf.Set(globalKeyName(dbi.Key()))
+		}
+	}
+
+	err = db.Update(func(tx Tx) error {
+		tx.Put(needFilterKey(repo, node), nf.bits)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nf, nil
+}
+
+// ldbLoadOrRebuildNeedFilter returns node's need filter for repo. If no
+// filter has been persisted yet - the node's first ldbWithNeed call, or
+// one made before this filter existed at all - it's rebuilt from the
+// authoritative global version list instead of starting from an empty
+// filter, which would otherwise force a full versionList decode for every
+// key in the repo until each file happened to be touched again.
+func ldbLoadOrRebuildNeedFilter(db Store, snap Snapshot, repo, node []byte) (*needFilter, error) {
+	_, err := snap.Get(needFilterKey(repo, node))
+	if err == leveldb.ErrNotFound {
+		return ldbRebuildNeedFilter(db, repo, node)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ldbLoadNeedFilter(snap, repo, node)
+}
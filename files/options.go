@@ -0,0 +1,32 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package files
+
+// Options tunes the behavior of a Store.
+type Options struct {
+	// BatchFlushThreshold is the number of pending writes an Update
+	// accumulates before they are flushed to disk and the underlying
+	// batch is reset. This bounds peak memory during large repo scans
+	// (full replace, drop-repo, ...) without relying on a GC pass
+	// afterwards to reclaim it. Zero means DefaultBatchFlushThreshold.
+	BatchFlushThreshold int
+
+	// RepairOnOpen, if set, makes the Store run ldbCheckGlobals/ldbRepair
+	// over every repo already present in the database before returning
+	// it, fixing any global-index (and, transitively, need-filter) drift
+	// left behind by a crash or an unclean shutdown mid-batch.
+	RepairOnOpen bool
+}
+
+// DefaultBatchFlushThreshold is used when Options.BatchFlushThreshold is
+// left at its zero value.
+const DefaultBatchFlushThreshold = 1000
+
+func (o Options) batchFlushThreshold() int {
+	if o.BatchFlushThreshold <= 0 {
+		return DefaultBatchFlushThreshold
+	}
+	return o.BatchFlushThreshold
+}
@@ -0,0 +1,262 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package files
+
+import (
+	"bytes"
+
+	"github.com/syncthing/syncthing/protocol"
+)
+
+// DiscrepancyKind classifies a single inconsistency found between the
+// keyTypeGlobal bucket and the authoritative keyTypeNode records it's
+// derived from.
+type DiscrepancyKind int
+
+const (
+	// OrphanGlobalVersion is a versionList entry in the global bucket
+	// whose node has no backing keyTypeNode record (or a record with a
+	// different version than claimed, or one marked invalid).
+	OrphanGlobalVersion DiscrepancyKind = iota
+	// OrphanNodeRecord is a valid (non-invalid) keyTypeNode record that
+	// isn't reflected in the global version list for its name.
+	OrphanNodeRecord
+)
+
+// Discrepancy describes one inconsistency found by ldbCheckGlobals.
+type Discrepancy struct {
+	Name    string
+	Node    protocol.NodeID
+	Version uint64
+	Kind    DiscrepancyKind
+}
+
+// ldbCheckGlobals walks the keyTypeGlobal bucket for repo and cross-checks
+// it against the authoritative keyTypeNode records. A panic in ldbGetGlobal
+// ("no versions?") or a crash mid-batch can otherwise leave the two buckets
+// out of sync with no way to notice short of that panic; this gives a way
+// to detect the problem ahead of time and a report to act on.
+func ldbCheckGlobals(db Store, repo []byte) ([]Discrepancy, error) {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	var discrepancies []Discrepancy
+
+	// Files with a valid node record, for the reverse check below.
+	haveValid := make(map[string]map[string]uint64) // name -> node -> version
+
+	nstart := nodeKey(repo, nil, nil)
+	nlimit := nodeKey(repo, protocol.LocalNodeID[:], []byte{0xff, 0xff, 0xff, 0xff})
+	ndbi := snap.RangeIterator(nstart, nlimit)
+	for ndbi.Next() {
+		var f protocol.FileInfoTruncated
+		if err := f.UnmarshalXDR(ndbi.Value()); err != nil {
+			ndbi.Release()
+			return nil, err
+		}
+		if f.IsInvalid() {
+			continue
+		}
+		node := string(nodeKeyNode(ndbi.Key()))
+		if haveValid[f.Name] == nil {
+			haveValid[f.Name] = make(map[string]uint64)
+		}
+		haveValid[f.Name][node] = f.Version
+	}
+	ndbi.Release()
+
+	gstart := globalKey(repo, nil)
+	glimit := globalKey(repo, []byte{0xff, 0xff, 0xff, 0xff})
+	gdbi := snap.RangeIterator(gstart, glimit)
+	for gdbi.Next() {
+		var vl versionList
+		if err := vl.UnmarshalXDR(gdbi.Value()); err != nil {
+			gdbi.Release()
+			return nil, err
+		}
+		name := string(globalKeyName(gdbi.Key()))
+
+		for _, v := range vl.versions {
+			fk := nodeKey(repo, v.node, []byte(name))
+			bs, err := snap.Get(fk)
+			if err != nil {
+				discrepancies = append(discrepancies, Discrepancy{
+					Name:    name,
+					Node:    protocol.NodeIDFromBytes(v.node),
+					Version: v.version,
+					Kind:    OrphanGlobalVersion,
+				})
+				continue
+			}
+			var f protocol.FileInfoTruncated
+			if err := f.UnmarshalXDR(bs); err != nil {
+				gdbi.Release()
+				return nil, err
+			}
+			if f.Version != v.version || f.IsInvalid() {
+				discrepancies = append(discrepancies, Discrepancy{
+					Name:    name,
+					Node:    protocol.NodeIDFromBytes(v.node),
+					Version: v.version,
+					Kind:    OrphanGlobalVersion,
+				})
+			}
+		}
+	}
+	gdbi.Release()
+
+	for name, nodes := range haveValid {
+		for node, version := range nodes {
+			if !globalListHas(db, repo, name, node, version) {
+				discrepancies = append(discrepancies, Discrepancy{
+					Name:    name,
+					Node:    protocol.NodeIDFromBytes([]byte(node)),
+					Version: version,
+					Kind:    OrphanNodeRecord,
+				})
+			}
+		}
+	}
+
+	return discrepancies, nil
+}
+
+func globalListHas(db Store, repo []byte, name, node string, version uint64) bool {
+	bs, err := db.Get(globalKey(repo, []byte(name)))
+	if err != nil {
+		return false
+	}
+	var vl versionList
+	if err := vl.UnmarshalXDR(bs); err != nil {
+		return false
+	}
+	for _, v := range vl.versions {
+		if bytes.Equal(v.node, []byte(node)) && v.version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// ldbRepair rebuilds the keyTypeGlobal bucket for repo from the
+// authoritative keyTypeNode records, fixing any discrepancies reported by
+// ldbCheckGlobals. Every affected name is corrected in a single
+// Store.Update call (which may flush in chunks; see the Store.Update
+// doc), and
+// the need filter of every node a discrepancy implicated is rebuilt
+// afterwards so it doesn't keep reflecting the now-corrected ordering's
+// stale predecessor. See repairAllRepos for how this gets run on startup
+// via Options.RepairOnOpen.
+func ldbRepair(db Store, repo []byte) ([]Discrepancy, error) {
+	discrepancies, err := ldbCheckGlobals(db, repo)
+	if err != nil {
+		return nil, err
+	}
+	if len(discrepancies) == 0 {
+		return nil, nil
+	}
+
+	names := make(map[string]bool, len(discrepancies))
+	nodes := make(map[string][]byte, len(discrepancies))
+	for _, d := range discrepancies {
+		names[d.Name] = true
+		nodes[string(d.Node[:])] = append([]byte(nil), d.Node[:]...)
+	}
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	byName := make(map[string][]fileVersion, len(names))
+	nstart := nodeKey(repo, nil, nil)
+	nlimit := nodeKey(repo, protocol.LocalNodeID[:], []byte{0xff, 0xff, 0xff, 0xff})
+	dbi := snap.RangeIterator(nstart, nlimit)
+	for dbi.Next() {
+		name := string(nodeKeyName(dbi.Key()))
+		if !names[name] {
+			continue
+		}
+		var f protocol.FileInfoTruncated
+		if err := f.UnmarshalXDR(dbi.Value()); err != nil {
+			dbi.Release()
+			return nil, err
+		}
+		if f.IsInvalid() {
+			continue
+		}
+		node := append([]byte(nil), nodeKeyNode(dbi.Key())...)
+		byName[name] = insertVersionSorted(byName[name], fileVersion{node: node, version: f.Version})
+	}
+	dbi.Release()
+
+	err = db.Update(func(tx Tx) error {
+		for name := range names {
+			gk := globalKey(repo, []byte(name))
+			versions := byName[name]
+			if len(versions) == 0 {
+				tx.Delete(gk)
+				continue
+			}
+			fl := versionList{versions: versions}
+			tx.Put(gk, fl.MarshalXDR())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The global version list for these names just changed, so any need
+	// filter bit that was set on the assumption of the old ordering may
+	// now be stale. Rebuild the filter for every node a discrepancy
+	// implicated rather than trying to patch individual bits - ldbRepair
+	// runs rarely, and correctness matters more than incremental cost
+	// here.
+	for _, node := range nodes {
+		if _, err := ldbRebuildNeedFilter(db, repo, node); err != nil {
+			return nil, err
+		}
+	}
+
+	return discrepancies, nil
+}
+
+// repairAllRepos runs ldbCheckGlobals/ldbRepair over every repo already
+// present in db. Called by newLeveldbStore/newMemStore when
+// Options.RepairOnOpen is set, so a database reopened after an unclean
+// shutdown has its global index - and the need filters layered on top of
+// it - brought back in sync before any other ldb* call sees it.
+func repairAllRepos(db Store) error {
+	repos, err := ldbListRepos(db)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		if _, err := ldbRepair(db, []byte(repo)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertVersionSorted inserts v into versions keeping the list sorted with
+// the highest version first, matching the ordering ldbUpdateGlobal
+// maintains.
+func insertVersionSorted(versions []fileVersion, v fileVersion) []fileVersion {
+	for i := range versions {
+		if versions[i].version <= v.version {
+			t := append(versions, fileVersion{})
+			copy(t[i+1:], t[i:])
+			t[i] = v
+			return t
+		}
+	}
+	return append(versions, v)
+}
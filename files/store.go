@@ -0,0 +1,289 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package files
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Store is the persistence backend used by the ldb* functions in this
+// package. It exists so that the goleveldb-specific
+// snapshot/batch/write dance that used to be repeated at the top of every
+// ldb* function can be centralized into Update, and so that alternate KV
+// engines can be benchmarked against the same workload without touching
+// the code above this abstraction.
+type Store interface {
+	// Get returns the value for key, or leveldb.ErrNotFound if it doesn't
+	// exist.
+	Get(key []byte) ([]byte, error)
+	// Snapshot returns a consistent, point-in-time view of the store. The
+	// caller must call Release on it when done.
+	Snapshot() (Snapshot, error)
+	// Update runs fn with a Tx that accumulates writes and commits them
+	// once fn returns nil. Implementations may flush and reset their
+	// underlying batch partway through a large Update to bound memory,
+	// so a failure partway through does not guarantee earlier writes in
+	// the same call are rolled back; callers that need atomicity across
+	// an entire Update should keep it small.
+	Update(fn func(tx Tx) error) error
+}
+
+// Snapshot is a consistent, point-in-time view of a Store.
+type Snapshot interface {
+	Get(key []byte) ([]byte, error)
+	// RangeIterator returns an iterator over keys in [start, limit). The
+	// caller must call Release on it when done.
+	RangeIterator(start, limit []byte) RangeIterator
+	Release()
+}
+
+// RangeIterator walks a range of keys in ascending order.
+type RangeIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+}
+
+// Tx accumulates writes for a single Update call.
+type Tx interface {
+	Put(key, value []byte)
+	Delete(key []byte)
+}
+
+// leveldbStore is the production Store implementation, backed by goleveldb.
+type leveldbStore struct {
+	db   *leveldb.DB
+	opts Options
+}
+
+// newLeveldbStore wraps an existing goleveldb handle as a Store. If
+// opts.RepairOnOpen is set, every repo already in db is checked and
+// repaired before the Store is returned.
+func newLeveldbStore(db *leveldb.DB, opts Options) (Store, error) {
+	s := &leveldbStore{db: db, opts: opts}
+	if opts.RepairOnOpen {
+		if err := repairAllRepos(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *leveldbStore) Get(key []byte) ([]byte, error) {
+	return s.db.Get(key, nil)
+}
+
+func (s *leveldbStore) Snapshot() (Snapshot, error) {
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &leveldbSnapshot{snap: snap}, nil
+}
+
+func (s *leveldbStore) Update(fn func(tx Tx) error) error {
+	tx := &leveldbTx{db: s.db, batch: new(leveldb.Batch), threshold: s.opts.batchFlushThreshold()}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if tx.err != nil {
+		return tx.err
+	}
+	return tx.flush()
+}
+
+type leveldbSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+func (s *leveldbSnapshot) Get(key []byte) ([]byte, error) {
+	return s.snap.Get(key, nil)
+}
+
+func (s *leveldbSnapshot) RangeIterator(start, limit []byte) RangeIterator {
+	return s.snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+}
+
+func (s *leveldbSnapshot) Release() {
+	s.snap.Release()
+}
+
+// leveldbTx accumulates writes for a single Update call, flushing and
+// resetting its batch every threshold operations so memory use during a
+// large Update (full repo replace, drop-repo, ...) stays bounded rather
+// than growing for the whole call.
+type leveldbTx struct {
+	db        *leveldb.DB
+	batch     *leveldb.Batch
+	threshold int
+	pending   int
+	err       error
+}
+
+func (t *leveldbTx) Put(key, value []byte) {
+	t.batch.Put(key, value)
+	t.maybeFlush()
+}
+
+func (t *leveldbTx) Delete(key []byte) {
+	t.batch.Delete(key)
+	t.maybeFlush()
+}
+
+func (t *leveldbTx) maybeFlush() {
+	if t.err != nil {
+		return
+	}
+	t.pending++
+	if t.pending >= t.threshold {
+		t.flush()
+	}
+}
+
+func (t *leveldbTx) flush() error {
+	if t.err != nil {
+		return t.err
+	}
+	if t.batch.Len() == 0 {
+		return nil
+	}
+	if err := t.db.Write(t.batch, nil); err != nil {
+		t.err = err
+		return err
+	}
+	t.batch.Reset()
+	t.pending = 0
+	return nil
+}
+
+// memStore is an in-memory Store, useful for tests and for benchmarking
+// alternate KV engines against the same workload without needing a real
+// leveldb instance on disk.
+type memStore struct {
+	mut  sync.RWMutex
+	data map[string][]byte
+}
+
+// newMemStore returns an empty in-memory Store. If opts.RepairOnOpen is
+// set, repairAllRepos runs against the new, still empty store, so there's
+// nothing to repair - the option is accepted for symmetry with
+// newLeveldbStore. A memStore ignores opts.BatchFlushThreshold.
+func newMemStore(opts Options) (Store, error) {
+	s := &memStore{data: make(map[string][]byte)}
+	if opts.RepairOnOpen {
+		if err := repairAllRepos(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *memStore) Get(key []byte) ([]byte, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	v, ok := s.data[string(key)]
+	if !ok {
+		return nil, leveldb.ErrNotFound
+	}
+	return v, nil
+}
+
+func (s *memStore) Snapshot() (Snapshot, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	cp := make(map[string][]byte, len(s.data))
+	for k, v := range s.data {
+		cp[k] = v
+	}
+	return &memSnapshot{data: cp}, nil
+}
+
+// Update applies all of fn's writes at once under the write lock, or none
+// of them if fn returns an error - unlike
+// leveldbStore.Update, which flushes in chunks (see the Store doc). This
+// is a memStore-only convenience for tests, not part of the Store
+// contract; callers that need atomicity should not rely on it holding for
+// leveldbStore too.
+func (s *memStore) Update(fn func(tx Tx) error) error {
+	tx := &memTx{puts: make(map[string][]byte), deletes: make(map[string]bool)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for k := range tx.deletes {
+		delete(s.data, k)
+	}
+	for k, v := range tx.puts {
+		s.data[k] = v
+	}
+	return nil
+}
+
+type memTx struct {
+	puts    map[string][]byte
+	deletes map[string]bool
+}
+
+func (t *memTx) Put(key, value []byte) {
+	delete(t.deletes, string(key))
+	t.puts[string(key)] = value
+}
+
+func (t *memTx) Delete(key []byte) {
+	delete(t.puts, string(key))
+	t.deletes[string(key)] = true
+}
+
+type memSnapshot struct {
+	data map[string][]byte
+}
+
+func (s *memSnapshot) Get(key []byte) ([]byte, error) {
+	v, ok := s.data[string(key)]
+	if !ok {
+		return nil, leveldb.ErrNotFound
+	}
+	return v, nil
+}
+
+func (s *memSnapshot) RangeIterator(start, limit []byte) RangeIterator {
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		if k >= string(start) && (limit == nil || k < string(limit)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return &memIterator{keys: keys, data: s.data, pos: -1}
+}
+
+func (s *memSnapshot) Release() {}
+
+type memIterator struct {
+	keys []string
+	data map[string][]byte
+	pos  int
+}
+
+func (it *memIterator) Next() bool {
+	it.pos++
+	return it.pos < len(it.keys)
+}
+
+func (it *memIterator) Key() []byte {
+	return []byte(it.keys[it.pos])
+}
+
+func (it *memIterator) Value() []byte {
+	return it.data[it.keys[it.pos]]
+}
+
+func (it *memIterator) Release() {}
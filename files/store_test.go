@@ -0,0 +1,231 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestMemStoreGetPutDelete(t *testing.T) {
+	s, err := newMemStore(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get([]byte("k")); err != leveldb.ErrNotFound {
+		t.Fatalf("Get on empty store: got err %v, want ErrNotFound", err)
+	}
+
+	err = s.Update(func(tx Tx) error {
+		tx.Put([]byte("k"), []byte("v1"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := s.Get([]byte("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "v1" {
+		t.Fatalf("Get: got %q, want %q", bs, "v1")
+	}
+
+	err = s.Update(func(tx Tx) error {
+		tx.Delete([]byte("k"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get([]byte("k")); err != leveldb.ErrNotFound {
+		t.Fatalf("Get after Delete: got err %v, want ErrNotFound", err)
+	}
+}
+
+// TestMemStoreUpdateRollsBackOnError documents a memStore-only
+// convenience, not a guarantee of the Store interface: memStore applies a
+// whole Update atomically under its write lock, but leveldbStore
+// is explicitly documented (see Store.Update) as flushing in chunks, so a
+// failure partway through a large leveldbStore Update can leave earlier
+// writes in that same call committed. Code relying on this test's
+// rollback behavior will break if pointed at leveldbStore.
+func TestMemStoreUpdateRollsBackOnError(t *testing.T) {
+	s, err := newMemStore(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boom := errDummy{}
+	err = s.Update(func(tx Tx) error {
+		tx.Put([]byte("k"), []byte("v1"))
+		return boom
+	})
+	if err != boom {
+		t.Fatalf("Update: got err %v, want %v", err, boom)
+	}
+
+	if _, err := s.Get([]byte("k")); err != leveldb.ErrNotFound {
+		t.Fatal("a write from a failed Update should not be visible")
+	}
+}
+
+type errDummy struct{}
+
+func (errDummy) Error() string { return "dummy error" }
+
+func TestMemStoreSnapshotIsolation(t *testing.T) {
+	s, err := newMemStore(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(func(tx Tx) error {
+		tx.Put([]byte("k"), []byte("v1"))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	if err := s.Update(func(tx Tx) error {
+		tx.Put([]byte("k"), []byte("v2"))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := snap.Get([]byte("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "v1" {
+		t.Fatalf("snapshot should not observe writes made after it was taken: got %q", bs)
+	}
+}
+
+func TestMemStoreRangeIterator(t *testing.T) {
+	s, err := newMemStore(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(func(tx Tx) error {
+		tx.Put([]byte("a"), []byte("1"))
+		tx.Put([]byte("b"), []byte("2"))
+		tx.Put([]byte("c"), []byte("3"))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	dbi := snap.RangeIterator([]byte("a"), []byte("c"))
+	defer dbi.Release()
+
+	var got []string
+	for dbi.Next() {
+		got = append(got, string(dbi.Key()))
+	}
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("RangeIterator [a, c): got %v, want [a b]", got)
+	}
+}
+
+func TestLeveldbStoreGetPutDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files-store-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ldb, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+
+	s, err := newLeveldbStore(ldb, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Update(func(tx Tx) error {
+		tx.Put([]byte("k"), []byte("v1"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := s.Get([]byte("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "v1" {
+		t.Fatalf("Get: got %q, want %q", bs, "v1")
+	}
+}
+
+func TestLeveldbStoreFlushesInChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files-store-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ldb, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+
+	s, err := newLeveldbStore(ldb, Options{BatchFlushThreshold: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Update(func(tx Tx) error {
+		tx.Put([]byte("a"), []byte("1"))
+		tx.Put([]byte("b"), []byte("2"))
+		// The threshold of 2 was reached, so a and b are already written.
+		if _, err := s.Get([]byte("a")); err != nil {
+			t.Fatalf("Get(a) after the first chunk: %v", err)
+		}
+		tx.Put([]byte("c"), []byte("3"))
+		// c is still pending until Update returns.
+		if _, err := s.Get([]byte("c")); err != leveldb.ErrNotFound {
+			t.Fatalf("Get(c) before Update returned: got err %v, want ErrNotFound", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"a", "b", "c"} {
+		bs, err := s.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("Get(%q): %v", k, err)
+		}
+		if len(bs) == 0 {
+			t.Fatalf("Get(%q): empty value", k)
+		}
+	}
+}